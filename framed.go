@@ -0,0 +1,199 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// frameHeaderSize is the size, in bytes, of the length/checksum header that
+// precedes every frame's payload: an 8-byte length followed by a 4-byte
+// CRC32C checksum.
+const frameHeaderSize = 8 + 4
+
+// crc32cTable is the Castagnoli CRC32 table used to checksum each frame
+// written by a FramedEncoder. Castagnoli is used rather than the IEEE
+// polynomial because it has better error-detection properties and is what
+// most modern checksum hardware accelerates.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A FramedEncoder writes a sequence of values to an underlying io.Writer,
+// each framed as [uint64 length][uint32 CRC32C][payload]. Unlike Encoder,
+// which requires both sides to agree in advance on the sequence of types
+// being written, a FramedDecoder reading a FramedEncoder's output can skip
+// over or verify any entry without decoding its payload, and an entry whose
+// payload is corrupt does not poison the entries that follow it. A corrupt
+// length in a header does: every later frame is then read from the wrong
+// offset.
+type FramedEncoder struct {
+	w   io.Writer
+	err error
+}
+
+// NewFramedEncoder returns a FramedEncoder that writes to w.
+func NewFramedEncoder(w io.Writer) *FramedEncoder {
+	return &FramedEncoder{w: w}
+}
+
+// Err returns the first error encountered while writing frames, if any.
+func (fe *FramedEncoder) Err() error {
+	return fe.err
+}
+
+// Encode writes the encoding of v to the underlying stream as a single
+// length- and checksum-framed entry. Like Marshal, Encode panics if v
+// contains a type it does not know how to encode.
+func (fe *FramedEncoder) Encode(v interface{}) error {
+	if fe.err != nil {
+		return fe.err
+	}
+	payload := Marshal(v)
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[:8], uint64(len(payload)))
+	binary.LittleEndian.PutUint32(header[8:], crc32.Checksum(payload, crc32cTable))
+	if _, err := fe.w.Write(header[:]); err != nil {
+		fe.err = err
+		return err
+	}
+	if _, err := fe.w.Write(payload); err != nil {
+		fe.err = err
+		return err
+	}
+	return nil
+}
+
+// A FramedDecoder reads a sequence of length- and checksum-framed entries
+// written by a FramedEncoder. Once a read fails, every subsequent read is a
+// no-op that returns the original error; call Err to retrieve it.
+//
+// Peek, Verify, Skip, and Decode all act on the next undecoded entry in the
+// stream. Peek and Verify do not advance past that entry, so either may be
+// followed by a call to Skip or Decode to consume it; Skip and Decode
+// always advance to the following entry.
+type FramedDecoder struct {
+	r       io.Reader
+	maxLen  uint64
+	haveHdr bool
+	length  uint64
+	crc     uint32
+	payload []byte
+	err     error
+}
+
+// NewFramedDecoder returns a FramedDecoder that reads from r. maxLen bounds
+// the size of any single entry's payload, preventing a corrupt or
+// malicious length prefix from triggering a huge allocation.
+func NewFramedDecoder(r io.Reader, maxLen int) *FramedDecoder {
+	return &FramedDecoder{r: r, maxLen: uint64(maxLen)}
+}
+
+// Err returns the first error encountered while reading frames, if any.
+func (fd *FramedDecoder) Err() error {
+	return fd.err
+}
+
+// readHeader reads and validates the header of the next entry, caching it
+// so that later calls (for the same entry) don't read it again.
+func (fd *FramedDecoder) readHeader() error {
+	if fd.err != nil {
+		return fd.err
+	}
+	if fd.haveHdr {
+		return nil
+	}
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fd.r, header[:]); err != nil {
+		fd.err = err
+		return err
+	}
+	length := binary.LittleEndian.Uint64(header[:8])
+	if length > fd.maxLen {
+		fd.err = fmt.Errorf("framed entry exceeds max length (%v > %v)", length, fd.maxLen)
+		return fd.err
+	}
+	fd.length = length
+	fd.crc = binary.LittleEndian.Uint32(header[8:])
+	fd.haveHdr = true
+	return nil
+}
+
+// readPayload reads the payload of the next entry, caching it so that later
+// calls (for the same entry) don't read it again.
+func (fd *FramedDecoder) readPayload() error {
+	if err := fd.readHeader(); err != nil {
+		return err
+	}
+	if fd.payload != nil {
+		return nil
+	}
+	payload := make([]byte, fd.length)
+	if _, err := io.ReadFull(fd.r, payload); err != nil {
+		fd.err = err
+		return err
+	}
+	fd.payload = payload
+	return nil
+}
+
+// advance discards the cached header and payload (if any) of the entry
+// just consumed, so that the next call to readHeader reads the following
+// entry.
+func (fd *FramedDecoder) advance() {
+	fd.haveHdr = false
+	fd.length = 0
+	fd.crc = 0
+	fd.payload = nil
+}
+
+// Peek returns the payload length of the next entry without consuming it.
+func (fd *FramedDecoder) Peek() (uint64, error) {
+	if err := fd.readHeader(); err != nil {
+		return 0, err
+	}
+	return fd.length, nil
+}
+
+// Verify reads the next entry's payload, if it has not already been read by
+// a prior call, and checks it against the entry's CRC32C checksum
+// without decoding it.
+func (fd *FramedDecoder) Verify() error {
+	if err := fd.readPayload(); err != nil {
+		return err
+	}
+	if crc32.Checksum(fd.payload, crc32cTable) != fd.crc {
+		return errors.New("frame failed checksum verification")
+	}
+	return nil
+}
+
+// Skip advances past the next entry without decoding it. If the entry's
+// payload has not yet been read by Verify, Skip discards it
+// directly from the underlying reader rather than buffering it.
+func (fd *FramedDecoder) Skip() error {
+	if err := fd.readHeader(); err != nil {
+		return err
+	}
+	if fd.payload == nil {
+		if _, err := io.CopyN(ioutil.Discard, fd.r, int64(fd.length)); err != nil {
+			fd.err = err
+			return err
+		}
+	}
+	fd.advance()
+	return nil
+}
+
+// Decode decodes the next entry's payload into v, which must be a non-nil
+// pointer, and advances past the entry. Decode does not check the entry's
+// checksum; call Verify first if that is required.
+func (fd *FramedDecoder) Decode(v interface{}) error {
+	if err := fd.readPayload(); err != nil {
+		return err
+	}
+	err := Unmarshal(fd.payload, v)
+	fd.advance()
+	return err
+}
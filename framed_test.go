@@ -0,0 +1,162 @@
+package encoding
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestFramedEncodeDecode tests that a sequence of heterogeneous values
+// round-trips through a FramedEncoder/FramedDecoder pair.
+func TestFramedEncodeDecode(t *testing.T) {
+	b := new(bytes.Buffer)
+	enc := NewFramedEncoder(b)
+	for i := range testStructs {
+		if err := enc.Encode(testStructs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewFramedDecoder(b, 1e6)
+	emptyStructs := []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
+	for i := range testStructs {
+		if err := dec.Decode(emptyStructs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(*emptyStructs[0].(*test0), testStructs[0]) {
+		t.Error("deep equal:", emptyStructs[0], testStructs[0])
+	}
+}
+
+// TestFramedPeek tests that Peek reports an entry's payload length without
+// consuming it, and that a subsequent Decode still succeeds.
+func TestFramedPeek(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := NewFramedEncoder(b).Encode("foo"); err != nil {
+		t.Fatal(err)
+	}
+	exp := uint64(len(Marshal("foo")))
+
+	dec := NewFramedDecoder(b, 1e6)
+	n, err := dec.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != exp {
+		t.Errorf("expected Peek to report %v, got %v", exp, n)
+	}
+	// Peek should not consume the entry
+	n, err = dec.Peek()
+	if err != nil || n != exp {
+		t.Errorf("second Peek: expected %v, nil, got %v, %v", exp, n, err)
+	}
+
+	var s string
+	if err := dec.Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "foo" {
+		t.Errorf("expected %q, got %q", "foo", s)
+	}
+}
+
+// TestFramedVerify tests that Verify accepts an intact entry, rejects a
+// corrupted one, and that a verified entry can still be decoded afterward.
+func TestFramedVerify(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := NewFramedEncoder(b).Encode("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewFramedDecoder(b, 1e6)
+	if err := dec.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := dec.Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "foo" {
+		t.Errorf("expected %q, got %q", "foo", s)
+	}
+
+	// corrupt a payload byte and confirm Verify catches it
+	corrupt := new(bytes.Buffer)
+	if err := NewFramedEncoder(corrupt).Encode("foo"); err != nil {
+		t.Fatal(err)
+	}
+	corruptBytes := corrupt.Bytes()
+	corruptBytes[len(corruptBytes)-1] ^= 0xFF
+	if err := NewFramedDecoder(bytes.NewReader(corruptBytes), 1e6).Verify(); err == nil {
+		t.Error("expected checksum verification to fail, got nil")
+	}
+}
+
+// TestFramedSkip tests that Skip advances past an entry, with or without a
+// preceding Peek, leaving later entries intact.
+func TestFramedSkip(t *testing.T) {
+	b := new(bytes.Buffer)
+	enc := NewFramedEncoder(b)
+	if err := enc.Encode("skip me"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode("skip me too"); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(uint64(42)); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewFramedDecoder(b, 1e6)
+	if err := dec.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	if err := dec.Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("expected 42, got %v", n)
+	}
+}
+
+// TestFramedMaxLen tests that a FramedDecoder rejects an entry whose
+// declared length exceeds maxLen, without allocating a buffer for it.
+func TestFramedMaxLen(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := NewFramedEncoder(b).Encode(bytes.Repeat([]byte{0}, 100)); err != nil {
+		t.Fatal(err)
+	}
+	dec := NewFramedDecoder(b, 10)
+	var out []byte
+	if err := dec.Decode(&out); err == nil {
+		t.Error("expected max length error, got nil")
+	}
+}
+
+// TestFramedShortStream tests that reading past the end of a truncated
+// stream returns an error rather than a zero-length entry.
+func TestFramedShortStream(t *testing.T) {
+	dec := NewFramedDecoder(bytes.NewReader([]byte{1, 2, 3}), 1e6)
+	if _, err := dec.Peek(); err == nil {
+		t.Error("expected error reading truncated header, got nil")
+	}
+
+	b := new(bytes.Buffer)
+	if err := NewFramedEncoder(b).Encode("foo"); err != nil {
+		t.Fatal(err)
+	}
+	truncated := b.Bytes()[:b.Len()-1]
+	dec = NewFramedDecoder(bytes.NewReader(truncated), 1e6)
+	var s string
+	if err := dec.Decode(&s); err == nil {
+		t.Error("expected error reading truncated payload, got nil")
+	}
+}
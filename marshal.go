@@ -0,0 +1,1098 @@
+// Package encoding converts arbitrary objects into byte slices, and writes
+// them to and reads them from io.Writers and io.Readers. Unlike encoding/gob,
+// it requires no type information beyond the Go type itself, and the wire
+// format is specified exactly: by default every integer is written as a
+// fixed 8-byte little-endian value, strings and slices are prefixed with
+// their length as a uint64, booleans occupy a single byte, and maps are written as a
+// length-prefixed sequence of key/value pairs with keys sorted so that the
+// encoding of a given map is always the same regardless of iteration order.
+// Floats are written as their IEEE-754 bits, with any NaN normalized to a
+// single canonical bit pattern. This makes the format stable across
+// versions and suitable for hashing and signing, at the cost of being
+// larger on the wire than a varint-based encoding. An Encoder created with
+// NewEncoderOpts and Opts.Varint writes integers and lengths in a
+// variable-length form instead (see Opts).
+//
+// Types that need custom behavior (e.g. unexported fields) can implement the
+// UploMarshaler and UploUnmarshaler interfaces.
+package encoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxSliceSize is the default maximum length allowed for a slice or
+	// string decoded via Unmarshal or ReadFile. It guards against
+	// allocating huge buffers in response to a malicious or corrupted
+	// length prefix.
+	maxSliceSize = 1 << 24
+)
+
+// ErrBadPointer is returned when Unmarshal (or Decoder.Decode) is called
+// with a value that is not a non-nil pointer.
+var ErrBadPointer = errors.New("cannot decode into invalid pointer")
+
+// A UploMarshaler can encode a representation of itself into a stream. This
+// allows types with unexported fields, or types that need a non-default
+// wire format, to control their own encoding.
+type UploMarshaler interface {
+	MarshalUplo(w io.Writer) error
+}
+
+// A UploUnmarshaler can decode a representation of itself from a stream.
+// It is the counterpart to UploMarshaler.
+type UploUnmarshaler interface {
+	UnmarshalUplo(r io.Reader) error
+}
+
+// fieldTag holds the parsed `uplo:"..."` struct tag for a single field.
+type fieldTag struct {
+	skip      bool
+	omitempty bool
+	fixed     bool
+}
+
+// parseFieldTag parses the `uplo` struct tag on f, if any, following the
+// comma-separated conventions of encoding/json: `uplo:"-"` skips the field
+// on both encode and decode; `uplo:",omitempty"` precedes the field with a
+// single-byte presence flag and omits the value when it is the zero value;
+// `uplo:"fixed"` is accepted only on a byte-array field, which is written
+// without a length prefix whether or not it carries the tag; on any other
+// field type (including []byte) it is rejected. A name may also be
+// given (e.g. `uplo:"myField,omitempty"`) for
+// compatibility with encoding/json-style tags, but since this package's wire
+// format is positional rather than name-keyed, the name itself has no
+// effect on encoding or decoding.
+func parseFieldTag(f reflect.StructField) fieldTag {
+	tag, ok := f.Tag.Lookup("uplo")
+	if !ok {
+		return fieldTag{}
+	}
+	if tag == "-" {
+		return fieldTag{skip: true}
+	}
+	var ft fieldTag
+	for _, opt := range strings.Split(tag, ",") {
+		switch opt {
+		case "omitempty":
+			ft.omitempty = true
+		case "fixed":
+			ft.fixed = true
+		}
+	}
+	return ft
+}
+
+// Opts configures optional behavior for an Encoder or Decoder.
+type Opts struct {
+	// Varint causes integers and length prefixes to be written using a
+	// gob-style variable-length encoding instead of the default fixed
+	// 8-byte little-endian representation. Values in [0, 0x7F] are
+	// written as a single byte; larger values are written as a count
+	// byte (0xFF - n) followed by n big-endian bytes, where n is the
+	// minimal number of bytes needed to hold the value. Signed integers
+	// are zig-zag transformed before being written. An Encoder created
+	// with Varint set writes a single wire-format flag byte ahead of the
+	// stream so that a corresponding Decoder can recover the format.
+	Varint bool
+}
+
+// A TypeRegistry maps type IDs to concrete types, allowing an Encoder and
+// Decoder created with NewEncoderWithRegistry/NewDecoderWithRegistry to
+// round-trip interface-typed fields: the concrete type is written as a
+// 4-byte ID followed by its normal encoding, and the Decoder uses the ID to
+// allocate a fresh instance of the matching registered type. The zero value
+// is not usable; construct one with NewTypeRegistry.
+type TypeRegistry struct {
+	idToType   map[uint32]reflect.Type
+	typeToID   map[reflect.Type]uint32
+	interfaces []reflect.Type
+}
+
+// NewTypeRegistry returns an empty TypeRegistry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		idToType: make(map[uint32]reflect.Type),
+		typeToID: make(map[reflect.Type]uint32),
+	}
+}
+
+// Register associates id with the type of prototype, so that values of that
+// type can be encoded and decoded through an interface-typed field. prototype
+// is typically a zero value or nil pointer of the concrete type, e.g.
+// Register(1, Foo{}) or Register(2, (*Bar)(nil)); a pointer prototype causes
+// decoded values to be assigned as a pointer. id must be nonzero, since zero
+// is reserved to mean "nil interface". Register panics if id is zero, if id
+// is already registered, or if one or more interfaces have been declared via
+// RegisterInterface and prototype's type implements none of them.
+func (tr *TypeRegistry) Register(id uint32, prototype interface{}) {
+	if id == 0 {
+		panic("encoding: type id 0 is reserved for nil interfaces")
+	}
+	if _, ok := tr.idToType[id]; ok {
+		panic(fmt.Sprintf("encoding: type id %v is already registered", id))
+	}
+	t := reflect.TypeOf(prototype)
+	if len(tr.interfaces) > 0 {
+		implements := false
+		for _, iface := range tr.interfaces {
+			if t.Implements(iface) {
+				implements = true
+				break
+			}
+		}
+		if !implements {
+			panic(fmt.Sprintf("encoding: type %v does not implement any registered interface", t))
+		}
+	}
+	tr.idToType[id] = t
+	tr.typeToID[t] = id
+}
+
+// RegisterInterface declares that values assigned to interface-typed fields
+// must implement iface, which should be passed as a nil pointer to the
+// interface type, e.g. RegisterInterface((*Fooer)(nil)). Subsequent calls to
+// Register panic if their prototype implements none of the interfaces
+// declared this way, catching registration mistakes at startup rather than
+// at encode time.
+func (tr *TypeRegistry) RegisterInterface(iface interface{}) {
+	t := reflect.TypeOf(iface)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+		panic("encoding: RegisterInterface requires a nil pointer to an interface type, e.g. (*Fooer)(nil)")
+	}
+	tr.interfaces = append(tr.interfaces, t.Elem())
+}
+
+// An Encoder writes objects to an underlying io.Writer using the encoding
+// scheme described in the package documentation.
+type Encoder struct {
+	w      io.Writer
+	varint bool
+	reg    *TypeRegistry
+	err    error
+}
+
+// Write implements io.Writer.
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// WriteByte writes a single byte to the underlying stream.
+func (e *Encoder) WriteByte(b byte) error {
+	_, err := e.Write([]byte{b})
+	return err
+}
+
+// WriteBool writes b as a single byte, 0 for false and 1 for true.
+func (e *Encoder) WriteBool(b bool) error {
+	if b {
+		return e.WriteByte(1)
+	}
+	return e.WriteByte(0)
+}
+
+// WriteUint64 writes u to the underlying stream as 8 little-endian bytes.
+func (e *Encoder) WriteUint64(u uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], u)
+	_, err := e.Write(buf[:])
+	return err
+}
+
+// WriteUint32 writes u to the underlying stream as 4 little-endian bytes.
+// It is used to write the type ID prefix of a registry-encoded interface
+// value.
+func (e *Encoder) WriteUint32(u uint32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], u)
+	_, err := e.Write(buf[:])
+	return err
+}
+
+// WriteVarint writes u using the variable-length encoding described by
+// Opts.Varint: values in [0, 0x7F] are written as a single byte; larger
+// values are written as a count byte (0xFF - n) followed by the minimal n
+// big-endian bytes needed to hold u.
+func (e *Encoder) WriteVarint(u uint64) error {
+	if u <= 0x7F {
+		return e.WriteByte(byte(u))
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	n := 8
+	for n > 1 && buf[8-n] == 0 {
+		n--
+	}
+	if err := e.WriteByte(0xFF - byte(n)); err != nil {
+		return err
+	}
+	_, err := e.Write(buf[8-n:])
+	return err
+}
+
+// writeLen writes a length or element count, using WriteVarint if the
+// Encoder was constructed with Opts.Varint, and WriteUint64 otherwise.
+func (e *Encoder) writeLen(n uint64) error {
+	if e.varint {
+		return e.WriteVarint(n)
+	}
+	return e.WriteUint64(n)
+}
+
+// WritePrefixedBytes writes b to the underlying stream, preceded by its
+// length.
+func (e *Encoder) WritePrefixedBytes(b []byte) error {
+	if err := e.writeLen(uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := e.Write(b)
+	return err
+}
+
+// Encode writes the encoding of v to the underlying stream. See the package
+// docstring for the rules governing the encoding of each type. Encode
+// panics if it encounters a type it does not know how to encode.
+func (e *Encoder) Encode(v interface{}) error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.encode(reflect.ValueOf(v))
+}
+
+// EncodeAll encodes each of vs in sequence.
+func (e *Encoder) EncodeAll(vs ...interface{}) error {
+	for _, v := range vs {
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) encode(val reflect.Value) error {
+	// nil pointers are encoded as a single false byte.
+	if val.Kind() == reflect.Ptr && val.IsNil() {
+		return e.WriteBool(false)
+	}
+
+	// Apart from the nil-pointer case above, a type with a custom marshaler
+	// takes precedence over the kind-based encodings below.
+	if val.CanInterface() {
+		if m, ok := val.Interface().(UploMarshaler); ok {
+			return m.MarshalUplo(e)
+		}
+	}
+	if val.CanAddr() && val.Addr().CanInterface() {
+		if m, ok := val.Addr().Interface().(UploMarshaler); ok {
+			return m.MarshalUplo(e)
+		}
+	}
+
+	switch val.Kind() {
+	case reflect.Ptr:
+		if err := e.WriteBool(true); err != nil {
+			return err
+		}
+		return e.encode(val.Elem())
+
+	case reflect.Bool:
+		return e.WriteBool(val.Bool())
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if e.varint {
+			return e.WriteVarint(zigzagEncode(val.Int()))
+		}
+		return e.WriteUint64(uint64(val.Int()))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return e.writeLen(val.Uint())
+
+	case reflect.Float32:
+		return e.WriteUint32(canonicalFloat32Bits(float32(val.Float())))
+
+	case reflect.Float64:
+		return e.WriteUint64(canonicalFloat64Bits(val.Float()))
+
+	case reflect.Complex64:
+		c := val.Complex()
+		if err := e.WriteUint32(canonicalFloat32Bits(float32(real(c)))); err != nil {
+			return err
+		}
+		return e.WriteUint32(canonicalFloat32Bits(float32(imag(c))))
+
+	case reflect.Complex128:
+		c := val.Complex()
+		if err := e.WriteUint64(canonicalFloat64Bits(real(c))); err != nil {
+			return err
+		}
+		return e.WriteUint64(canonicalFloat64Bits(imag(c)))
+
+	case reflect.String:
+		return e.WritePrefixedBytes([]byte(val.String()))
+
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return e.WritePrefixedBytes(val.Bytes())
+		}
+		if err := e.writeLen(uint64(val.Len())); err != nil {
+			return err
+		}
+		for i := 0; i < val.Len(); i++ {
+			if err := e.encode(val.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			if !val.CanAddr() {
+				addr := reflect.New(val.Type()).Elem()
+				addr.Set(val)
+				val = addr
+			}
+			_, err := e.Write(val.Slice(0, val.Len()).Bytes())
+			return err
+		}
+		for i := 0; i < val.Len(); i++ {
+			if err := e.encode(val.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Interface:
+		return e.encodeInterface(val)
+
+	case reflect.Map:
+		if err := e.writeLen(uint64(val.Len())); err != nil {
+			return err
+		}
+		keys := val.MapKeys()
+		sortMapKeys(keys)
+		for _, k := range keys {
+			if err := e.encode(k); err != nil {
+				return err
+			}
+			if err := e.encode(val.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Struct:
+		t := val.Type()
+		for i := 0; i < val.NumField(); i++ {
+			f := t.Field(i)
+			tag := parseFieldTag(f)
+			if tag.skip {
+				continue
+			}
+			if f.PkgPath != "" && !f.Anonymous {
+				panic(fmt.Sprintf("encoding: type %v has unexported field %q; implement MarshalUplo/UnmarshalUplo", t, f.Name))
+			}
+			fv := val.Field(i)
+			if tag.omitempty {
+				empty := fv.IsZero()
+				if err := e.WriteBool(!empty); err != nil {
+					return err
+				}
+				if empty {
+					continue
+				}
+			}
+			if tag.fixed && !implementsMarshaler(fv) {
+				if err := e.encodeFixed(fv); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		panic("encoding: could not encode unsupported type " + val.Type().String())
+	}
+}
+
+// implementsMarshaler reports whether val, or a pointer to it, implements
+// UploMarshaler, mirroring the precedence check at the top of encode. It is
+// used to let a custom marshaler take priority over a uplo:"fixed" tag.
+func implementsMarshaler(val reflect.Value) bool {
+	if val.CanInterface() {
+		if _, ok := val.Interface().(UploMarshaler); ok {
+			return true
+		}
+	}
+	if val.CanAddr() && val.Addr().CanInterface() {
+		if _, ok := val.Addr().Interface().(UploMarshaler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// implementsUnmarshaler reports whether a pointer to val implements
+// UploUnmarshaler, mirroring the precedence check at the top of decode. It
+// is used to let a custom unmarshaler take priority over a uplo:"fixed"
+// tag.
+func implementsUnmarshaler(val reflect.Value) bool {
+	if !val.CanAddr() || !val.Addr().CanInterface() {
+		return false
+	}
+	_, ok := val.Addr().Interface().(UploUnmarshaler)
+	return ok
+}
+
+// encodeFixed encodes val, which carries no length prefix, for use by struct
+// fields tagged uplo:"fixed". Only byte arrays are accepted, since their
+// length is fixed by the type itself; a []byte field
+// has no such guarantee, and a decoder reading into a nil or short slice
+// would silently desync the rest of the stream.
+func (e *Encoder) encodeFixed(val reflect.Value) error {
+	if val.Kind() != reflect.Array || val.Type().Elem().Kind() != reflect.Uint8 {
+		panic(`encoding: uplo:"fixed" is only valid on byte-array fields`)
+	}
+	return e.encode(val)
+}
+
+// encodeInterface encodes an interface-typed value using the Encoder's
+// TypeRegistry: a nil interface is written as a 4-byte type ID of 0;
+// otherwise the concrete value's registered type ID is written, followed by
+// the value's normal encoding. decodeInterface always reconstructs a fresh,
+// non-nil instance of the registered type via reflect.New, so when that
+// type was registered as a pointer (e.g. Register(2, (*cat)(nil))), only the
+// pointee's encoding is written here, with no presence bool, to match.
+func (e *Encoder) encodeInterface(val reflect.Value) error {
+	if val.IsNil() {
+		return e.WriteUint32(0)
+	}
+	if e.reg == nil {
+		return fmt.Errorf("encoding: cannot encode interface value of type %v without a TypeRegistry", val.Elem().Type())
+	}
+	elem := val.Elem()
+	id, ok := e.reg.typeToID[elem.Type()]
+	if !ok {
+		return fmt.Errorf("encoding: type %v is not registered", elem.Type())
+	}
+	if err := e.WriteUint32(id); err != nil {
+		return err
+	}
+	if elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			elem = reflect.Zero(elem.Type().Elem())
+		} else {
+			elem = elem.Elem()
+		}
+	}
+	return e.encode(elem)
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// NewEncoderWithRegistry returns an Encoder that writes to w and uses reg to
+// resolve the concrete types of interface-typed fields. The default
+// Encoder returned by NewEncoder has no registry and returns an error if it
+// encounters an interface-typed field.
+func NewEncoderWithRegistry(w io.Writer, reg *TypeRegistry) *Encoder {
+	return &Encoder{w: w, reg: reg}
+}
+
+// NewEncoderOpts returns an Encoder that writes to w according to opts. A
+// single wire-format flag byte (1 if opts.Varint is set, 0 otherwise) is
+// written to w immediately, ahead of any encoded values, so that a
+// corresponding Decoder created with NewDecoderOpts can recover the format.
+func NewEncoderOpts(w io.Writer, opts Opts) *Encoder {
+	e := &Encoder{w: w, varint: opts.Varint}
+	var flag byte
+	if opts.Varint {
+		flag = 1
+	}
+	e.err = e.WriteByte(flag)
+	return e
+}
+
+// zigzagEncode maps a signed integer to an unsigned integer using zig-zag
+// encoding, so that small absolute values (positive or negative) map to
+// small unsigned values.
+func zigzagEncode(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+// zigzagDecode is the inverse of zigzagEncode.
+func zigzagDecode(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// canonicalFloat32NaN and canonicalFloat64NaN are the bit patterns written
+// for any NaN value, regardless of its original payload or sign bit, so
+// that encoding a float is deterministic and suitable for hashing.
+const (
+	canonicalFloat32NaN = 0x7FC00000
+	canonicalFloat64NaN = 0x7FF8000000000001
+)
+
+// canonicalFloat32Bits returns the bits of f, normalizing any NaN to
+// canonicalFloat32NaN.
+func canonicalFloat32Bits(f float32) uint32 {
+	if f != f {
+		return canonicalFloat32NaN
+	}
+	return math.Float32bits(f)
+}
+
+// canonicalFloat64Bits returns the bits of f, normalizing any NaN to
+// canonicalFloat64NaN.
+func canonicalFloat64Bits(f float64) uint64 {
+	if f != f {
+		return canonicalFloat64NaN
+	}
+	return math.Float64bits(f)
+}
+
+// sortMapKeys sorts keys in place so that encoding a map always produces the
+// same bytes regardless of the map's iteration order. Integer keys are
+// ordered by value and string keys lexicographically; any other key type
+// (including byte slices/arrays and structs) is ordered by the bytes of its
+// own encoding.
+func sortMapKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+	switch keys[0].Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() })
+	case reflect.String:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	default:
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(Marshal(keys[i].Interface()), Marshal(keys[j].Interface())) < 0
+		})
+	}
+}
+
+// A Decoder reads objects from an underlying io.Reader using the encoding
+// scheme described in the package documentation. Once a read fails, every
+// subsequent read is a no-op that returns the original error; call Err to
+// retrieve it.
+type Decoder struct {
+	r      io.Reader
+	maxLen uint64
+	varint bool
+	reg    *TypeRegistry
+	err    error
+}
+
+func (d *Decoder) setErr(err error) {
+	if d.err == nil && err != nil {
+		d.err = err
+	}
+}
+
+// Err returns the first error encountered during decoding, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Read implements io.Reader. Once the Decoder has encountered an error, Read
+// is a no-op that returns that error.
+func (d *Decoder) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := io.ReadFull(d.r, p)
+	d.setErr(err)
+	return n, err
+}
+
+// readByte reads a single byte from the underlying stream.
+func (d *Decoder) readByte() byte {
+	var buf [1]byte
+	d.Read(buf[:])
+	return buf[0]
+}
+
+// ReadBool reads a single byte and interprets it as a boolean. Any value
+// other than 0 or 1 is treated as a decoding error.
+func (d *Decoder) ReadBool() bool {
+	b := d.readByte()
+	if d.err != nil {
+		return false
+	}
+	if b > 1 {
+		d.setErr(errors.New("boolean value was not 0 or 1"))
+		return false
+	}
+	return b == 1
+}
+
+// ReadUint64 reads 8 little-endian bytes from the underlying stream.
+func (d *Decoder) ReadUint64() uint64 {
+	var buf [8]byte
+	d.Read(buf[:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// ReadUint32 reads 4 little-endian bytes from the underlying stream. It is
+// used to read the type ID prefix of a registry-encoded interface value.
+func (d *Decoder) ReadUint32() uint32 {
+	var buf [4]byte
+	d.Read(buf[:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// ReadVarint reads a value written by Encoder.WriteVarint.
+func (d *Decoder) ReadVarint() uint64 {
+	b := d.readByte()
+	if d.err != nil {
+		return 0
+	}
+	if b <= 0x7F {
+		return uint64(b)
+	}
+	n := int(0xFF - b)
+	if n < 1 || n > 8 {
+		d.setErr(fmt.Errorf("invalid varint length byte %#x", b))
+		return 0
+	}
+	var buf [8]byte
+	d.Read(buf[8-n:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// readLen reads a length or element count, using ReadVarint if the Decoder
+// was constructed with Opts.Varint, and ReadUint64 otherwise.
+func (d *Decoder) readLen() uint64 {
+	if d.varint {
+		return d.ReadVarint()
+	}
+	return d.ReadUint64()
+}
+
+// ReadPrefixedBytes reads a length prefix followed by that many bytes. The
+// length is bounds-checked against the Decoder's maxLen before the buffer
+// is allocated.
+func (d *Decoder) ReadPrefixedBytes() []byte {
+	n := d.readLen()
+	if d.err != nil {
+		return nil
+	}
+	if n > d.maxLen {
+		d.setErr(fmt.Errorf("encoded object exceeds max length (%v > %v)", n, d.maxLen))
+		return nil
+	}
+	b := make([]byte, n)
+	d.Read(b)
+	if d.err != nil {
+		return nil
+	}
+	return b
+}
+
+// Decode reads the next encoded value from the underlying stream and stores
+// it in v, which must be a non-nil pointer.
+func (d *Decoder) Decode(v interface{}) error {
+	pval := reflect.ValueOf(v)
+	if pval.Kind() != reflect.Ptr || pval.IsNil() {
+		return ErrBadPointer
+	}
+	if err := d.decode(pval.Elem()); err != nil {
+		return fmt.Errorf("could not decode type %v: %v", pval.Elem().Type(), err)
+	}
+	return nil
+}
+
+// DecodeAll decodes each of vs in sequence.
+func (d *Decoder) DecodeAll(vs ...interface{}) error {
+	for _, v := range vs {
+		if err := d.Decode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decode(val reflect.Value) error {
+	if d.err != nil {
+		return d.err
+	}
+	if val.CanAddr() && val.Addr().CanInterface() {
+		if u, ok := val.Addr().Interface().(UploUnmarshaler); ok {
+			return u.UnmarshalUplo(d)
+		}
+	}
+
+	switch val.Kind() {
+	case reflect.Ptr:
+		present := d.ReadBool()
+		if d.err != nil {
+			return d.err
+		}
+		if !present {
+			val.Set(reflect.Zero(val.Type()))
+			return nil
+		}
+		elem := reflect.New(val.Type().Elem())
+		if err := d.decode(elem.Elem()); err != nil {
+			return err
+		}
+		val.Set(elem)
+		return nil
+
+	case reflect.Bool:
+		b := d.ReadBool()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetBool(b)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if d.varint {
+			u := d.ReadVarint()
+			if d.err != nil {
+				return d.err
+			}
+			val.SetInt(zigzagDecode(u))
+			return nil
+		}
+		u := d.ReadUint64()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetInt(int64(u))
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := d.readLen()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetUint(u)
+		return nil
+
+	case reflect.Float32:
+		u := d.ReadUint32()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetFloat(float64(math.Float32frombits(u)))
+		return nil
+
+	case reflect.Float64:
+		u := d.ReadUint64()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetFloat(math.Float64frombits(u))
+		return nil
+
+	case reflect.Complex64:
+		ru := d.ReadUint32()
+		iu := d.ReadUint32()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetComplex(complex128(complex(math.Float32frombits(ru), math.Float32frombits(iu))))
+		return nil
+
+	case reflect.Complex128:
+		ru := d.ReadUint64()
+		iu := d.ReadUint64()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetComplex(complex(math.Float64frombits(ru), math.Float64frombits(iu)))
+		return nil
+
+	case reflect.String:
+		b := d.ReadPrefixedBytes()
+		if d.err != nil {
+			return d.err
+		}
+		val.SetString(string(b))
+		return nil
+
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			b := d.ReadPrefixedBytes()
+			if d.err != nil {
+				return d.err
+			}
+			val.SetBytes(b)
+			return nil
+		}
+		n := d.readLen()
+		if d.err != nil {
+			return d.err
+		}
+		if n > d.maxLen {
+			return fmt.Errorf("encoded object exceeds max length (%v > %v)", n, d.maxLen)
+		}
+		slice := reflect.MakeSlice(val.Type(), int(n), int(n))
+		for i := 0; i < int(n); i++ {
+			if err := d.decode(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		val.Set(slice)
+		return nil
+
+	case reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			if !val.CanAddr() {
+				return errors.New("cannot decode into unaddressable byte array")
+			}
+			d.Read(val.Slice(0, val.Len()).Bytes())
+			return d.err
+		}
+		for i := 0; i < val.Len(); i++ {
+			if err := d.decode(val.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Interface:
+		return d.decodeInterface(val)
+
+	case reflect.Map:
+		n := d.readLen()
+		if d.err != nil {
+			return d.err
+		}
+		if n > d.maxLen {
+			return fmt.Errorf("encoded object exceeds max length (%v > %v)", n, d.maxLen)
+		}
+		t := val.Type()
+		m := reflect.MakeMapWithSize(t, int(n))
+		for i := uint64(0); i < n; i++ {
+			k := reflect.New(t.Key()).Elem()
+			if err := d.decode(k); err != nil {
+				return err
+			}
+			if m.MapIndex(k).IsValid() {
+				return fmt.Errorf("duplicate map key %v", k.Interface())
+			}
+			v := reflect.New(t.Elem()).Elem()
+			if err := d.decode(v); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, v)
+		}
+		val.Set(m)
+		return nil
+
+	case reflect.Struct:
+		t := val.Type()
+		for i := 0; i < val.NumField(); i++ {
+			f := t.Field(i)
+			tag := parseFieldTag(f)
+			if tag.skip {
+				continue
+			}
+			if f.PkgPath != "" && !f.Anonymous {
+				return fmt.Errorf("type %v has unexported field %q; implement MarshalUplo/UnmarshalUplo", t, f.Name)
+			}
+			fv := val.Field(i)
+			if tag.omitempty {
+				present := d.ReadBool()
+				if d.err != nil {
+					return d.err
+				}
+				if !present {
+					fv.Set(reflect.Zero(fv.Type()))
+					continue
+				}
+			}
+			if tag.fixed && !implementsUnmarshaler(fv) {
+				if err := d.decodeFixed(fv); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(fv); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return errors.New("unknown type")
+	}
+}
+
+// decodeFixed is the counterpart to Encoder.encodeFixed, for use by struct
+// fields tagged uplo:"fixed". Since no length is transmitted for a fixed
+// field, only byte arrays are accepted: their length is fixed by the type
+// itself, so there is no destination size for the decoder to guess at (and
+// get wrong) the way there would be for a []byte field.
+func (d *Decoder) decodeFixed(val reflect.Value) error {
+	if val.Kind() != reflect.Array || val.Type().Elem().Kind() != reflect.Uint8 {
+		return errors.New(`uplo:"fixed" is only valid on byte-array fields`)
+	}
+	return d.decode(val)
+}
+
+// decodeInterface decodes an interface-typed value using the Decoder's
+// TypeRegistry: a type ID of 0 means a nil interface; any other ID is
+// looked up in the registry, a fresh instance of the matching registered
+// type is allocated and decoded into, and the result is assigned to val.
+func (d *Decoder) decodeInterface(val reflect.Value) error {
+	id := d.ReadUint32()
+	if d.err != nil {
+		return d.err
+	}
+	if id == 0 {
+		val.Set(reflect.Zero(val.Type()))
+		return nil
+	}
+	if d.reg == nil {
+		return errors.New("cannot decode interface value without a TypeRegistry")
+	}
+	t, ok := d.reg.idToType[id]
+	if !ok {
+		return fmt.Errorf("unknown type id %v", id)
+	}
+	concrete := t
+	isPtr := concrete.Kind() == reflect.Ptr
+	if isPtr {
+		concrete = concrete.Elem()
+	}
+	ptr := reflect.New(concrete)
+	if err := d.decode(ptr.Elem()); err != nil {
+		return err
+	}
+	if isPtr {
+		val.Set(ptr)
+	} else {
+		val.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// NewDecoder returns a Decoder that reads from r. maxLen bounds the length
+// or element count of any single slice, string, or map decoded from r,
+// preventing a corrupt or malicious length prefix from triggering a huge
+// allocation.
+func NewDecoder(r io.Reader, maxLen int) *Decoder {
+	return &Decoder{r: r, maxLen: uint64(maxLen)}
+}
+
+// NewDecoderWithRegistry returns a Decoder that reads from r and uses reg to
+// resolve the type IDs of interface-typed fields written by an Encoder
+// created with NewEncoderWithRegistry. maxLen has the same meaning as in
+// NewDecoder.
+func NewDecoderWithRegistry(r io.Reader, maxLen int, reg *TypeRegistry) *Decoder {
+	return &Decoder{r: r, maxLen: uint64(maxLen), reg: reg}
+}
+
+// NewDecoderOpts returns a Decoder that reads from r, which must have been
+// written to by an Encoder created with NewEncoderOpts. The wire-format
+// flag byte at the start of the stream is read immediately and determines
+// whether the Decoder expects varint or fixed-width integers; opts is
+// accepted for symmetry with NewEncoderOpts but the format is always taken
+// from the stream itself, so that fixed-width and varint streams written by
+// NewEncoderOpts can both be read with the same call. A stream written by
+// NewEncoder has no flag byte and is read with NewDecoder.
+func NewDecoderOpts(r io.Reader, maxLen int, opts Opts) *Decoder {
+	d := &Decoder{r: r, maxLen: uint64(maxLen)}
+	flag := d.readByte()
+	if d.err != nil {
+		return d
+	}
+	d.varint = flag != 0
+	return d
+}
+
+// Marshal returns the encoding of v.
+func Marshal(v interface{}) []byte {
+	b := new(bytes.Buffer)
+	// bytes.Buffer.Write never returns an error, so the only way Encode can
+	// fail here is by panicking on an unsupported type.
+	if err := NewEncoder(b).Encode(v); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// Unmarshal decodes the encoding in b into v, which must be a non-nil
+// pointer.
+func Unmarshal(b []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(b), maxSliceSize).Decode(v)
+}
+
+// MarshalAll encodes each of vs in sequence and returns the concatenated
+// result.
+func MarshalAll(vs ...interface{}) []byte {
+	b := new(bytes.Buffer)
+	enc := NewEncoder(b)
+	for _, v := range vs {
+		if err := enc.Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// UnmarshalAll decodes the sequence of values encoded in b into vs, each of
+// which must be a non-nil pointer.
+func UnmarshalAll(b []byte, vs ...interface{}) error {
+	return NewDecoder(bytes.NewReader(b), maxSliceSize).DecodeAll(vs...)
+}
+
+// WriteFile writes v to a file at filename, truncating and overwriting any
+// existing file.
+func WriteFile(filename string, v interface{}) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return NewEncoder(file).Encode(v)
+}
+
+// ReadFile reads the encoding stored at filename into v, which must be a
+// non-nil pointer.
+func ReadFile(filename string, v interface{}) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return NewDecoder(file, maxSliceSize).Decode(v)
+}
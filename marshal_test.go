@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -27,6 +28,14 @@ func TempDir(dirs ...string) string {
 	return path
 }
 
+// badReader is an io.Reader that always returns an error, used to test that
+// decoding errors are propagated correctly.
+type badReader struct{}
+
+func (br *badReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
 // dummy types to test encoding
 type (
 	// basic
@@ -65,6 +74,20 @@ type (
 	}
 	// nil pointer
 	test7 struct{}
+	// floats and complexes
+	test8 struct {
+		F32  float32
+		F64  float64
+		C64  complex64
+		C128 complex128
+	}
+	// uplo struct tags: skip, omitempty, and fixed
+	test10 struct {
+		test0
+		Skip string  `uplo:"-"`
+		Opt  string  `uplo:",omitempty"`
+		Hash [2]byte `uplo:"fixed"`
+	}
 )
 
 func (t test5) MarshalUplo(w io.Writer) error {
@@ -97,6 +120,7 @@ var testStructs = []interface{}{
 	test5{"foo"},
 	&test6{"foo"},
 	(*test7)(nil),
+	test8{1.5, -2.5, complex(1.5, -1.5), complex(2.5, -3.5)},
 }
 
 var testEncodings = [][]byte{
@@ -112,6 +136,12 @@ var testEncodings = [][]byte{
 	{3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o'},
 	{3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o'},
 	{0},
+	{
+		0x00, 0x00, 0xc0, 0x3f, // F32 = 1.5
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0xc0, // F64 = -2.5
+		0x00, 0x00, 0xc0, 0x3f, 0x00, 0x00, 0xc0, 0xbf, // C64 = 1.5-1.5i
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0xc0, // C128 = 2.5-3.5i
+	},
 }
 
 // TestEncode tests the Encode function.
@@ -130,7 +160,7 @@ func TestEncode(t *testing.T) {
 			t.Error("expected panic, got nil")
 		}
 	}()
-	err := NewEncoder(ioutil.Discard).Encode(map[int]int{})
+	err := NewEncoder(ioutil.Discard).Encode(make(chan int))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,7 +172,7 @@ func TestDecode(t *testing.T) {
 		t.SkipNow()
 	}
 	// use Unmarshal for convenience
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	for i := range testEncodings {
 		err := Unmarshal(testEncodings[i], emptyStructs[i])
 		if err != nil {
@@ -163,8 +193,8 @@ func TestDecode(t *testing.T) {
 	}
 
 	// unknown type
-	err = Unmarshal([]byte{1, 2, 3}, new(map[int]int))
-	if err == nil || err.Error() != "could not decode type map[int]int: unknown type" {
+	err = Unmarshal([]byte{1, 2, 3}, new(chan int))
+	if err == nil || err.Error() != "could not decode type chan int: unknown type" {
 		t.Error("expected unknown type error, got", err)
 	}
 
@@ -186,7 +216,7 @@ func TestDecode(t *testing.T) {
 // TestMarshalUnmarshal tests the Marshal and Unmarshal functions, which are
 // inverses of each other.
 func TestMarshalUnmarshal(t *testing.T) {
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	for i := range testStructs {
 		b := Marshal(testStructs[i])
 		err := Unmarshal(b, emptyStructs[i])
@@ -199,7 +229,7 @@ func TestMarshalUnmarshal(t *testing.T) {
 // TestEncodeDecode tests the Encode and Decode functions, which are inverses
 // of each other.
 func TestEncodeDecode(t *testing.T) {
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	b := new(bytes.Buffer)
 	enc := NewEncoder(b)
 	dec := NewDecoder(b, 1e6)
@@ -262,7 +292,7 @@ func TestDecodeAll(t *testing.T) {
 		t.Error(err)
 	}
 
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	err = NewDecoder(b, 1e6).DecodeAll(emptyStructs...)
 	if err != nil {
 		t.Error(err)
@@ -322,7 +352,7 @@ func TestMarshalAll(t *testing.T) {
 func TestUnmarshalAll(t *testing.T) {
 	b := MarshalAll(testStructs...)
 
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	err := UnmarshalAll(b, emptyStructs...)
 	if err != nil {
 		t.Error(err)
@@ -351,6 +381,385 @@ func TestUnmarshalAll(t *testing.T) {
 	}
 }
 
+// TestWriteVarint tests the wire format produced by Encoder.WriteVarint.
+func TestWriteVarint(t *testing.T) {
+	tests := []struct {
+		val uint64
+		exp []byte
+	}{
+		{0, []byte{0}},
+		{1, []byte{1}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0xFE, 0x80}},
+		{0xFF, []byte{0xFE, 0xFF}},
+		{0xFFFF, []byte{0xFD, 0xFF, 0xFF}},
+		{1<<64 - 1, []byte{0xF7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, tt := range tests {
+		b := new(bytes.Buffer)
+		if err := NewEncoder(b).WriteVarint(tt.val); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), tt.exp) {
+			t.Errorf("WriteVarint(%#x): expected %v, got %v", tt.val, tt.exp, b.Bytes())
+		}
+		got := NewDecoder(b, 1e6).ReadVarint()
+		if got != tt.val {
+			t.Errorf("round trip of %#x produced %#x", tt.val, got)
+		}
+	}
+}
+
+// TestEncoderOptsVarint tests encoding and decoding structs through an
+// Encoder/Decoder pair configured with Opts{Varint: true}.
+func TestEncoderOptsVarint(t *testing.T) {
+	b := new(bytes.Buffer)
+	enc := NewEncoderOpts(b, Opts{Varint: true})
+	for i := range testStructs {
+		if err := enc.Encode(testStructs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the varint encoding should be considerably smaller than the
+	// fixed-width encoding, since most of testStructs' integers are small.
+	if fixed := len(MarshalAll(testStructs...)); b.Len() >= fixed {
+		t.Errorf("expected varint encoding (%v bytes) to be smaller than fixed-width encoding (%v bytes)", b.Len(), fixed)
+	}
+
+	dec := NewDecoderOpts(b, 1e6, Opts{Varint: true})
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
+	for i := range testStructs {
+		if err := dec.Decode(emptyStructs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(*emptyStructs[0].(*test0), testStructs[0]) {
+		t.Error("deep equal:", emptyStructs[0], testStructs[0])
+	}
+}
+
+// testMaps and testMapEncodings parallel testStructs/testEncodings, but for
+// map types, whose encoding must not depend on Go's randomized map
+// iteration order.
+var testMaps = []interface{}{
+	map[int]int{2: 20, 1: 10, 3: 30},
+	map[string]int{"foo": 1, "bar": 2},
+}
+
+var testMapEncodings = [][]byte{
+	{
+		3, 0, 0, 0, 0, 0, 0, 0, // 3 entries
+		1, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, // 1: 10
+		2, 0, 0, 0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0, // 2: 20
+		3, 0, 0, 0, 0, 0, 0, 0, 30, 0, 0, 0, 0, 0, 0, 0, // 3: 30
+	},
+	{
+		2, 0, 0, 0, 0, 0, 0, 0, // 2 entries
+		3, 0, 0, 0, 0, 0, 0, 0, 'b', 'a', 'r', 2, 0, 0, 0, 0, 0, 0, 0, // "bar": 2
+		3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o', 1, 0, 0, 0, 0, 0, 0, 0, // "foo": 1
+	},
+}
+
+// TestMapEncode tests that maps are encoded with their keys sorted, so that
+// the output of Marshal is deterministic regardless of iteration order.
+func TestMapEncode(t *testing.T) {
+	for i := range testMaps {
+		b := Marshal(testMaps[i])
+		if !bytes.Equal(b, testMapEncodings[i]) {
+			t.Errorf("bad encoding of testMaps[%d]: \nexp:\t%v\ngot:\t%v", i, testMapEncodings[i], b)
+		}
+	}
+}
+
+// TestMapDecode tests decoding into maps, including rejection of duplicate
+// keys and of element counts that exceed maxLen.
+func TestMapDecode(t *testing.T) {
+	var m1 map[int]int
+	if err := Unmarshal(testMapEncodings[0], &m1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m1, testMaps[0]) {
+		t.Error("deep equal:", m1, testMaps[0])
+	}
+
+	var m2 map[string]int
+	if err := Unmarshal(testMapEncodings[1], &m2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2, testMaps[1]) {
+		t.Error("deep equal:", m2, testMaps[1])
+	}
+
+	// duplicate key
+	dup := []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0}
+	var m3 map[int]int
+	err := Unmarshal(dup, &m3)
+	if err == nil || err.Error() != "could not decode type map[int]int: duplicate map key 1" {
+		t.Error("expected duplicate key error, got", err)
+	}
+
+	// element count exceeds maxLen
+	var m4 map[int]int
+	err = NewDecoder(bytes.NewReader(testMapEncodings[0]), 2).Decode(&m4)
+	if err == nil || err.Error() != "could not decode type map[int]int: encoded object exceeds max length (3 > 2)" {
+		t.Error("expected max length error, got", err)
+	}
+}
+
+// types used to test polymorphic interface encoding via a TypeRegistry
+type (
+	animal interface {
+		Sound() string
+	}
+	dog struct {
+		Name string
+	}
+	cat struct {
+		Name string
+	}
+	test9 struct {
+		A animal
+		B []animal
+		C *animal
+	}
+)
+
+func (d dog) Sound() string  { return "woof" }
+func (c *cat) Sound() string { return "meow" }
+
+func newAnimalRegistry() *TypeRegistry {
+	reg := NewTypeRegistry()
+	reg.RegisterInterface((*animal)(nil))
+	reg.Register(1, dog{})
+	reg.Register(2, (*cat)(nil))
+	return reg
+}
+
+// TestRegistryNilInterface tests that a nil interface-typed field encodes
+// as a single 4-byte type ID of 0, regardless of the registry in use. The
+// interface must be tested as a struct field rather than passed directly
+// to Encode, since a nil value of a named interface type loses its static
+// type (and so its Kind) when converted to the bare interface{} that Encode
+// accepts.
+func TestRegistryNilInterface(t *testing.T) {
+	type holder struct {
+		A animal
+	}
+	reg := newAnimalRegistry()
+	b := new(bytes.Buffer)
+	if err := NewEncoderWithRegistry(b, reg).Encode(holder{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), []byte{0, 0, 0, 0}) {
+		t.Errorf("expected nil interface field to encode as a zero type id, got %v", b.Bytes())
+	}
+	var out holder
+	if err := NewDecoderWithRegistry(b, 1e6, reg).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.A != nil {
+		t.Errorf("expected decoded interface to be nil, got %v", out.A)
+	}
+}
+
+// TestRegistryEncodeDecode tests round-tripping interface-typed fields,
+// including slices of interfaces and pointers to interfaces, and concrete
+// types with both value and pointer receivers.
+func TestRegistryEncodeDecode(t *testing.T) {
+	reg := newAnimalRegistry()
+	var c animal = &cat{"Tom"}
+
+	in := test9{
+		A: dog{"Rex"},
+		B: []animal{dog{"Fido"}, &cat{"Felix"}},
+		C: &c,
+	}
+	b := new(bytes.Buffer)
+	if err := NewEncoderWithRegistry(b, reg).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+
+	var out test9
+	if err := NewDecoderWithRegistry(b, 1e6, reg).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.A.Sound() != "woof" || out.A.(dog).Name != "Rex" {
+		t.Errorf("bad decode of A: %v", out.A)
+	}
+	if len(out.B) != 2 || out.B[0].(dog).Name != "Fido" || out.B[1].(*cat).Name != "Felix" {
+		t.Errorf("bad decode of B: %v", out.B)
+	}
+	if out.C == nil || (*out.C).Sound() != "meow" || (*out.C).(*cat).Name != "Tom" {
+		t.Errorf("bad decode of C: %v", out.C)
+	}
+}
+
+// TestRegistryErrors tests the error paths of registry-based interface
+// encoding: an unregistered concrete type at encode time, an unknown type ID
+// at decode time, and encoding/decoding without a registry at all.
+func TestRegistryErrors(t *testing.T) {
+	reg := newAnimalRegistry()
+
+	// unregistered concrete type
+	type bird struct{}
+	err := NewEncoderWithRegistry(ioutil.Discard, reg).Encode(&struct{ A interface{} }{A: bird{}})
+	if err == nil {
+		t.Error("expected error encoding unregistered type, got nil")
+	}
+
+	// unknown type id
+	b := bytes.NewReader([]byte{99, 0, 0, 0})
+	var out animal
+	err = NewDecoderWithRegistry(b, 1e6, reg).Decode(&out)
+	if err == nil {
+		t.Error("expected error decoding unknown type id, got nil")
+	}
+
+	// no registry at all
+	var a animal = dog{"Rex"}
+	err = NewEncoder(ioutil.Discard).Encode(&a)
+	if err == nil {
+		t.Error("expected error encoding interface without a registry, got nil")
+	}
+	err = NewDecoder(bytes.NewReader([]byte{1, 0, 0, 0}), 1e6).Decode(&out)
+	if err == nil {
+		t.Error("expected error decoding interface without a registry, got nil")
+	}
+}
+
+// TestRegistryPanics tests that Register panics on a zero id, a duplicate
+// id, and a prototype that implements none of the registered interfaces.
+func TestRegistryPanics(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected panic, got nil", name)
+			}
+		}()
+		f()
+	}
+
+	mustPanic("zero id", func() {
+		NewTypeRegistry().Register(0, dog{})
+	})
+	mustPanic("duplicate id", func() {
+		reg := NewTypeRegistry()
+		reg.Register(1, dog{})
+		reg.Register(1, cat{})
+	})
+	mustPanic("non-implementing type", func() {
+		reg := NewTypeRegistry()
+		reg.RegisterInterface((*animal)(nil))
+		reg.Register(1, struct{}{})
+	})
+}
+
+// testTagStructs and testTagEncodings parallel testStructs/testEncodings,
+// but for structs using the uplo struct tag.
+var testTagStructs = []test10{
+	// Opt is its zero value, so it is omitted; Skip is never encoded.
+	{test0: test0{false, 65537, 256, "foo"}, Skip: "ignored", Opt: "", Hash: [2]byte{0xAA, 0xBB}},
+	// Opt is non-zero, so it is present.
+	{test0: test0{false, 65537, 256, "foo"}, Skip: "ignored", Opt: "bar", Hash: [2]byte{0xAA, 0xBB}},
+}
+
+var testTagEncodings = [][]byte{
+	{
+		0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o', // test0
+		0,          // Opt omitted
+		0xAA, 0xBB, // Hash, no length prefix
+	},
+	{
+		0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o', // test0
+		1, 3, 0, 0, 0, 0, 0, 0, 0, 'b', 'a', 'r', // Opt present
+		0xAA, 0xBB, // Hash, no length prefix
+	},
+}
+
+// TestTagEncode tests that uplo struct tags are honored by Encode: skipped
+// fields are omitted entirely, omitempty fields are preceded by a presence
+// flag and dropped when zero, and fixed fields omit their length prefix.
+func TestTagEncode(t *testing.T) {
+	for i := range testTagStructs {
+		b := Marshal(testTagStructs[i])
+		if !bytes.Equal(b, testTagEncodings[i]) {
+			t.Errorf("bad encoding of testTagStructs[%d]: \nexp:\t%v\ngot:\t%v", i, testTagEncodings[i], b)
+		}
+	}
+}
+
+// TestTagDecode tests decoding structs using uplo struct tags.
+func TestTagDecode(t *testing.T) {
+	for i := range testTagEncodings {
+		var out test10
+		if err := Unmarshal(testTagEncodings[i], &out); err != nil {
+			t.Fatal(err)
+		}
+		// Skip is never decoded, so it stays at its zero value.
+		want := testTagStructs[i]
+		want.Skip = ""
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("decode of testTagEncodings[%d]: \nexp:\t%+v\ngot:\t%+v", i, want, out)
+		}
+	}
+}
+
+// TestTagFixedByteSlice tests that uplo:"fixed" is rejected on a []byte
+// field, since unlike a byte array, a slice has no length of its own for
+// the decoder to rely on.
+func TestTagFixedByteSlice(t *testing.T) {
+	type badFixed struct {
+		Hash []byte `uplo:"fixed"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic encoding uplo:\"fixed\" []byte field, got nil")
+		}
+	}()
+	Marshal(badFixed{Hash: []byte{1, 2}})
+}
+
+// TestFloatEncodeDecode tests that NaN values are normalized to a single
+// canonical bit pattern on encode, regardless of their original payload,
+// and that decoding a truncated stream reports an error rather than
+// returning a zero value.
+func TestFloatEncodeDecode(t *testing.T) {
+	// two different NaN bit patterns should produce identical encodings
+	nan1 := math.Float64frombits(0x7FF8000000000001)
+	nan2 := math.Float64frombits(0xFFF0000000000001) // different sign/payload
+	if !math.IsNaN(nan1) || !math.IsNaN(nan2) {
+		t.Fatal("test setup: expected both values to be NaN")
+	}
+	if !bytes.Equal(Marshal(nan1), Marshal(nan2)) {
+		t.Errorf("expected NaN encodings to match regardless of payload: %v != %v", Marshal(nan1), Marshal(nan2))
+	}
+
+	nan32a := math.Float32frombits(0x7FC00001)
+	nan32b := math.Float32frombits(0xFFC00002)
+	if !bytes.Equal(Marshal(nan32a), Marshal(nan32b)) {
+		t.Errorf("expected float32 NaN encodings to match regardless of payload: %v != %v", Marshal(nan32a), Marshal(nan32b))
+	}
+
+	// short input should be reported as an error, not silently zero-filled
+	var f32 float32
+	if err := Unmarshal([]byte{1, 2, 3}, &f32); err == nil {
+		t.Error("expected error decoding truncated float32, got nil")
+	}
+	var f64 float64
+	if err := Unmarshal([]byte{1, 2, 3}, &f64); err == nil {
+		t.Error("expected error decoding truncated float64, got nil")
+	}
+	var c64 complex64
+	if err := Unmarshal([]byte{1, 2, 3}, &c64); err == nil {
+		t.Error("expected error decoding truncated complex64, got nil")
+	}
+	var c128 complex128
+	if err := Unmarshal([]byte{1, 2, 3}, &c128); err == nil {
+		t.Error("expected error decoding truncated complex128, got nil")
+	}
+}
+
 // TestReadWriteFile tests the ReadFiles and WriteFile functions, which are
 // inverses of each other.
 func TestReadWriteFile(t *testing.T) {
@@ -402,7 +811,7 @@ func BenchmarkEncode(b *testing.B) {
 // i5-4670K, 9a90f86: 26 MB/s
 func BenchmarkDecode(b *testing.B) {
 	b.ReportAllocs()
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	var numBytes int64
 	for i := 0; i < b.N; i++ {
 		numBytes = 0
@@ -429,7 +838,7 @@ func BenchmarkMarshalAll(b *testing.B) {
 // i5-4670K, 2059112: 36 MB/s
 func BenchmarkUnmarshalAll(b *testing.B) {
 	b.ReportAllocs()
-	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}}
+	var emptyStructs = []interface{}{&test0{}, &test1{}, &test2{}, &test3{}, &test4{}, &test5{}, &test6{}, &test7{}, &test8{}}
 	structBytes := bytes.Join(testEncodings, nil)
 	for i := 0; i < b.N; i++ {
 		err := UnmarshalAll(structBytes, emptyStructs...)